@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"senan.xyz/g/gonic/tags"
+)
+
+// runInspect backs the `gonic inspect <path>` subcommand, printing every
+// tag gonic's reader found in a file - handy for working out why a track
+// didn't get a MusicBrainz ID, or what a tagger actually wrote.
+func runInspect(path string) error {
+	tg, err := tags.Read(path)
+	if err != nil {
+		return fmt.Errorf("reading tags: %v", err)
+	}
+	raw := tg.Raw()
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%-28s %s\n", key, raw[key])
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"senan.xyz/g/gonic/db"
+)
+
+// runUseMBZID backs the `gonic use_mbzid` subcommand. It's a one-shot,
+// run by hand after a library's been rescanned with MusicBrainz tagging
+// turned on: it merges every group of albums, and of artists, that share
+// an MBID into a single row. It only merges rows that already exist: the
+// scanner still looks albums up by path and library, so a renamed folder
+// or another library's copy gets a new album row on the next scan.
+func runUseMBZID(gdb *db.DB) error {
+	mergedAlbums, err := mergeAlbumsByMBZID(gdb)
+	if err != nil {
+		return err
+	}
+	mergedArtists, err := mergeAlbumArtistsByMBZID(gdb)
+	if err != nil {
+		return err
+	}
+	log.Printf("use_mbzid: merged %d duplicate album(s) and %d duplicate artist(s) by MusicBrainz ID\n",
+		mergedAlbums, mergedArtists)
+	return nil
+}
+
+// mergeAlbumsByMBZID groups albums by MusicBrainzID and, for each group of
+// two or more, keeps the lowest-ID row as canonical: every duplicate's
+// tracks are re-pointed at it, its rating/star/play-count are merged
+// forward onto the survivor, and the duplicate is then removed.
+func mergeAlbumsByMBZID(gdb *db.DB) (int, error) {
+	var albums []*db.Album
+	if err := gdb.Find(&albums).Error; err != nil {
+		return 0, fmt.Errorf("listing albums: %v", err)
+	}
+	groups := map[string][]*db.Album{}
+	for _, album := range albums {
+		if album.MusicBrainzID != "" {
+			groups[album.MusicBrainzID] = append(groups[album.MusicBrainzID], album)
+		}
+	}
+	merged := 0
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		canonical := lowestAlbumID(group)
+		for _, album := range group {
+			if album.ID == canonical.ID {
+				continue
+			}
+			if album.PlayCount > canonical.PlayCount {
+				canonical.PlayCount = album.PlayCount
+			}
+			if album.Rating > canonical.Rating {
+				canonical.Rating = album.Rating
+			}
+			if album.StarredAt != nil && (canonical.StarredAt == nil || album.StarredAt.After(*canonical.StarredAt)) {
+				canonical.StarredAt = album.StarredAt
+			}
+			if err := gdb.
+				Model(&db.Track{}).
+				Where("album_id = ?", album.ID).
+				Update("album_id", canonical.ID).
+				Error; err != nil {
+				return merged, fmt.Errorf("re-keying tracks for album %d: %v", album.ID, err)
+			}
+			if err := gdb.Delete(album).Error; err != nil {
+				return merged, fmt.Errorf("deleting duplicate album %d: %v", album.ID, err)
+			}
+			merged++
+		}
+		if err := gdb.Save(canonical).Error; err != nil {
+			return merged, fmt.Errorf("saving merged album %d: %v", canonical.ID, err)
+		}
+	}
+	return merged, nil
+}
+
+func lowestAlbumID(group []*db.Album) *db.Album {
+	canonical := group[0]
+	for _, album := range group[1:] {
+		if album.ID < canonical.ID {
+			canonical = album
+		}
+	}
+	return canonical
+}
+
+// mergeAlbumArtistsByMBZID does the same for album_artists: a folder
+// rename or cross-library scan can produce two artist rows for the same
+// MusicBrainz artist ID, each with its own albums and tracks pointing at
+// it. The lowest-ID row in each group is kept as canonical.
+func mergeAlbumArtistsByMBZID(gdb *db.DB) (int, error) {
+	var artists []*db.AlbumArtist
+	if err := gdb.Find(&artists).Error; err != nil {
+		return 0, fmt.Errorf("listing album artists: %v", err)
+	}
+	groups := map[string][]*db.AlbumArtist{}
+	for _, artist := range artists {
+		if artist.MusicBrainzID != "" {
+			groups[artist.MusicBrainzID] = append(groups[artist.MusicBrainzID], artist)
+		}
+	}
+	merged := 0
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		canonical := group[0]
+		for _, artist := range group[1:] {
+			if artist.ID < canonical.ID {
+				canonical = artist
+			}
+		}
+		for _, artist := range group {
+			if artist.ID == canonical.ID {
+				continue
+			}
+			if err := gdb.
+				Model(&db.Album{}).
+				Where("album_artist_id = ?", artist.ID).
+				Update("album_artist_id", canonical.ID).
+				Error; err != nil {
+				return merged, fmt.Errorf("re-keying albums for artist %d: %v", artist.ID, err)
+			}
+			if err := gdb.
+				Model(&db.Track{}).
+				Where("album_artist_id = ?", artist.ID).
+				Update("album_artist_id", canonical.ID).
+				Error; err != nil {
+				return merged, fmt.Errorf("re-keying tracks for artist %d: %v", artist.ID, err)
+			}
+			if err := gdb.Delete(artist).Error; err != nil {
+				return merged, fmt.Errorf("deleting duplicate artist %d: %v", artist.ID, err)
+			}
+			merged++
+		}
+	}
+	return merged, nil
+}
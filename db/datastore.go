@@ -0,0 +1,403 @@
+package db
+
+import (
+	"context"
+
+	"github.com/jinzhu/gorm"
+
+	"senan.xyz/g/gonic/playlist/smart"
+	"senan.xyz/g/gonic/server/ctrlsubsonic/filter"
+)
+
+// DataStore is what the scanner and ctrlsubsonic.Controller depend on
+// instead of a raw *gorm.DB. It groups the typed repositories together so
+// callers never see GORM directly, and so a request or a scan can bind all
+// of its work to a single transaction via WithTx.
+type DataStore interface {
+	MusicFolderRepository
+	AlbumRepository
+	TrackRepository
+	FolderRepository
+	CoverRepository
+	AlbumArtistRepository
+	ScanRepository
+	PlaylistRepository
+	PlayQueueRepository
+	PropertyRepository
+
+	// WithContext returns a DataStore that carries ctx. Controllers call
+	// this once per request with r.Context(). ctx is stored but not passed
+	// on to GORM, so cancelling it does not cancel a running query. It
+	// does not open a transaction: the returned DataStore is a local
+	// variable inside the handler that creates it, so nothing could ever
+	// call a commit/rollback on that exact instance - each call goes
+	// through its own connection instead, same as before WithContext
+	// existed. WithTx below is the only way to get a real transaction,
+	// because it owns the whole lifetime of the one it opens.
+	WithContext(ctx context.Context) DataStore
+	// WithTx runs fn against a DataStore bound to a transaction, committing
+	// on a nil return and rolling back otherwise. The scanner wraps its
+	// entire walk of a library in a single WithTx call.
+	WithTx(fn func(tx DataStore) error) error
+}
+
+type MusicFolderRepository interface {
+	GetMusicFolders() ([]*MusicFolder, error)
+	GetMusicFolder(id int) (*MusicFolder, error)
+}
+
+type AlbumRepository interface {
+	GetAlbum(id int) (*Album, error)
+	GetAlbumByPath(path string, libraryID int) (*Album, error)
+	SaveAlbum(album *Album) error
+	// GetAlbumList runs a filter.Options built by one of the
+	// filter.Strategy functions - the single query builder every
+	// getAlbumList2 `type` goes through.
+	GetAlbumList(opts filter.Options, limit, offset int) ([]*Album, error)
+}
+
+type TrackRepository interface {
+	// GetTrack returns a track with its Album preloaded, as every caller
+	// in ctrlsubsonic needs it to build a spec.TrackChild.
+	GetTrack(id int) (*Track, error)
+	GetTrackByPath(path string, libraryID int) (*Track, error)
+	SaveTrack(track *Track) error
+	DeleteTrack(track *Track) error
+	CountTracks() (int, error)
+	GetRandomTracks(opts RandomTracksOptions) ([]*Track, error)
+	// ListTrackPaths returns every track's ID and Path for a library, for
+	// the scanner's post-walk cleanup pass.
+	ListTrackPaths(libraryID int) ([]*Track, error)
+	// GetTracksByIDs batch-loads tracks in a single query and returns them
+	// in the same order as ids, so callers like ServeGetPlayQueue don't
+	// have to run one query per track.
+	GetTracksByIDs(ids []int) ([]*Track, error)
+}
+
+// RandomTracksOptions scopes a GetRandomTracks call the same way the
+// Subsonic `getRandomSongs` parameters do.
+type RandomTracksOptions struct {
+	Size        int
+	FromYear    int
+	ToYear      int
+	MusicFolder int // 0 means "every library"
+}
+
+type FolderRepository interface {
+	GetFolderByPath(path string, libraryID int) (*Folder, error)
+	SaveFolder(folder *Folder) error
+}
+
+type CoverRepository interface {
+	GetCoverByPath(path string, libraryID int) (*Cover, error)
+	SaveCover(cover *Cover) error
+}
+
+type AlbumArtistRepository interface {
+	// GetOrCreateAlbumArtist looks an artist up by name, creating it if
+	// needed. musicBrainzID is stashed on creation, and backfilled onto
+	// an existing row that doesn't have one yet, so a later `use_mbzid`
+	// re-key has something to go on.
+	GetOrCreateAlbumArtist(name, musicBrainzID string) (*AlbumArtist, error)
+}
+
+// ScanRepository groups the bulk maintenance queries the scanner needs
+// after a walk, so the orphan-cleanup DELETE SQL stays in the db
+// package instead of leaking into scanner.
+type ScanRepository interface {
+	CleanupLibrary(libraryID int) error
+}
+
+type PlaylistRepository interface {
+	GetPlaylist(id int) (*Playlist, error)
+	GetPlaylistsByUser(userID int) ([]*Playlist, error)
+	GetOrCreatePlaylist(id int) (*Playlist, error)
+	SavePlaylist(playlist *Playlist) error
+	DeletePlaylist(id int) error
+	// GetPlaylistWithTracks loads a playlist and its tracks, in order, with
+	// a single JOIN against playlist_tracks instead of one query per track.
+	GetPlaylistWithTracks(id int) (*Playlist, []*Track, error)
+	SetPlaylistTracks(playlistID int, trackIDs []int) error
+	// InsertPlaylistTrack appends or inserts a single track without
+	// rewriting the rest of the list - what ServeUpdatePlaylist uses for
+	// a pure add, instead of SetPlaylistTracks's delete-and-reinsert-all.
+	InsertPlaylistTrack(playlistID, trackID, position int) error
+	// GetSmartPlaylistTracks materializes a smart playlist's tracks by
+	// running its compiled playlist/smart.Query, instead of reading
+	// stored playlist_tracks rows.
+	GetSmartPlaylistTracks(q *smart.Query) ([]*Track, error)
+}
+
+type PlayQueueRepository interface {
+	GetPlayQueue(userID int) (*PlayQueue, error)
+	SavePlayQueue(queue *PlayQueue) error
+}
+
+type PropertyRepository interface {
+	GetProperty(key string) string
+	SetProperty(key, value string) error
+}
+
+// gormDataStore is the default DataStore, backed by a *DB that may or may
+// not already be a transaction depending on how it was obtained.
+type gormDataStore struct {
+	ctx context.Context
+	db  *DB
+}
+
+// NewDataStore wraps gdb as the root DataStore a Controller or Scanner is
+// constructed with.
+func NewDataStore(gdb *DB) DataStore {
+	return &gormDataStore{db: gdb}
+}
+
+func (d *gormDataStore) WithContext(ctx context.Context) DataStore {
+	return &gormDataStore{ctx: ctx, db: d.db}
+}
+
+func (d *gormDataStore) WithTx(fn func(tx DataStore) error) error {
+	tx := d.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	scoped := &gormDataStore{ctx: d.ctx, db: &DB{DB: tx}}
+	if err := fn(scoped); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (d *gormDataStore) conn() *gorm.DB {
+	return d.db.DB
+}
+
+func (d *gormDataStore) GetMusicFolders() ([]*MusicFolder, error) {
+	var folders []*MusicFolder
+	err := d.conn().Find(&folders).Error
+	return folders, err
+}
+
+func (d *gormDataStore) GetMusicFolder(id int) (*MusicFolder, error) {
+	folder := &MusicFolder{}
+	err := d.conn().First(folder, id).Error
+	return folder, err
+}
+
+func (d *gormDataStore) GetAlbum(id int) (*Album, error) {
+	album := &Album{}
+	err := d.conn().Preload("Cover").First(album, id).Error
+	return album, err
+}
+
+func (d *gormDataStore) GetAlbumByPath(path string, libraryID int) (*Album, error) {
+	album := &Album{}
+	err := d.conn().
+		Where("path = ? AND library_id = ?", path, libraryID).
+		First(album).
+		Error
+	return album, err
+}
+
+func (d *gormDataStore) SaveAlbum(album *Album) error {
+	return d.conn().Save(album).Error
+}
+
+func (d *gormDataStore) GetAlbumList(opts filter.Options, limit, offset int) ([]*Album, error) {
+	q := d.conn().Limit(limit).Offset(offset)
+	for _, join := range opts.Joins {
+		q = q.Joins(join)
+	}
+	if opts.Where != "" {
+		q = q.Where(opts.Where, opts.Args...)
+	}
+	if opts.MusicFolder != 0 {
+		q = q.Where("library_id = ?", opts.MusicFolder)
+	}
+	if opts.Sort != "" {
+		order := opts.Order
+		if order == "" {
+			order = "asc"
+		}
+		q = q.Order(opts.Sort + " " + order)
+	}
+	var albums []*Album
+	err := q.Find(&albums).Error
+	return albums, err
+}
+
+func (d *gormDataStore) GetTrack(id int) (*Track, error) {
+	track := &Track{}
+	err := d.conn().Preload("Album").First(track, id).Error
+	return track, err
+}
+
+func (d *gormDataStore) GetTrackByPath(path string, libraryID int) (*Track, error) {
+	track := &Track{}
+	err := d.conn().
+		Where("path = ? AND library_id = ?", path, libraryID).
+		First(track).
+		Error
+	return track, err
+}
+
+func (d *gormDataStore) SaveTrack(track *Track) error {
+	return d.conn().Save(track).Error
+}
+
+func (d *gormDataStore) DeleteTrack(track *Track) error {
+	return d.conn().Delete(track).Error
+}
+
+func (d *gormDataStore) CountTracks() (int, error) {
+	var count int
+	err := d.conn().Model(Track{}).Count(&count).Error
+	return count, err
+}
+
+func (d *gormDataStore) GetRandomTracks(opts RandomTracksOptions) ([]*Track, error) {
+	q := d.conn().
+		Limit(opts.Size).
+		Where("albums.tag_year BETWEEN ? AND ?", opts.FromYear, opts.ToYear).
+		Joins("JOIN albums ON tracks.album_id=albums.id").
+		Preload("Album").
+		Order(gorm.Expr("random()"))
+	if opts.MusicFolder != 0 {
+		q = q.Where("tracks.library_id = ?", opts.MusicFolder)
+	}
+	var tracks []*Track
+	err := q.Find(&tracks).Error
+	return tracks, err
+}
+
+func (d *gormDataStore) ListTrackPaths(libraryID int) ([]*Track, error) {
+	var tracks []*Track
+	err := d.conn().
+		Select("id, path").
+		Where("library_id = ?", libraryID).
+		Find(&tracks).
+		Error
+	return tracks, err
+}
+
+func (d *gormDataStore) GetTracksByIDs(ids []int) ([]*Track, error) {
+	var tracks []*Track
+	if err := d.conn().Preload("Album").Where("id IN (?)", ids).Find(&tracks).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[int]*Track, len(tracks))
+	for _, track := range tracks {
+		byID[track.ID] = track
+	}
+	ordered := make([]*Track, 0, len(ids))
+	for _, id := range ids {
+		if track, ok := byID[id]; ok {
+			ordered = append(ordered, track)
+		}
+	}
+	return ordered, nil
+}
+
+func (d *gormDataStore) GetFolderByPath(path string, libraryID int) (*Folder, error) {
+	folder := &Folder{}
+	err := d.conn().
+		Where("path = ? AND library_id = ?", path, libraryID).
+		First(folder).
+		Error
+	return folder, err
+}
+
+func (d *gormDataStore) SaveFolder(folder *Folder) error {
+	return d.conn().Save(folder).Error
+}
+
+func (d *gormDataStore) GetCoverByPath(path string, libraryID int) (*Cover, error) {
+	cover := &Cover{}
+	err := d.conn().
+		Where("path = ? AND library_id = ?", path, libraryID).
+		First(cover).
+		Error
+	return cover, err
+}
+
+func (d *gormDataStore) SaveCover(cover *Cover) error {
+	return d.conn().Save(cover).Error
+}
+
+func (d *gormDataStore) GetOrCreateAlbumArtist(name, musicBrainzID string) (*AlbumArtist, error) {
+	albumArtist := &AlbumArtist{}
+	err := d.conn().Where("name = ?", name).First(albumArtist).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		albumArtist.Name = name
+		albumArtist.MusicBrainzID = musicBrainzID
+		err = d.conn().Save(albumArtist).Error
+	case err == nil && albumArtist.MusicBrainzID == "" && musicBrainzID != "":
+		albumArtist.MusicBrainzID = musicBrainzID
+		err = d.conn().Save(albumArtist).Error
+	}
+	return albumArtist, err
+}
+
+func (d *gormDataStore) CleanupLibrary(libraryID int) error {
+	conn := d.conn()
+	if err := conn.Exec(`
+        DELETE FROM albums
+        WHERE  library_id = ?
+        AND    (SELECT count(id)
+                FROM   tracks
+                WHERE  album_id = albums.id) = 0;
+       `, libraryID).Error; err != nil {
+		return err
+	}
+	return conn.Exec(`
+        DELETE FROM album_artists
+        WHERE  (SELECT count(id)
+                FROM   albums
+                WHERE  album_artist_id = album_artists.id) = 0;
+    `).Error
+}
+
+func (d *gormDataStore) GetPlaylist(id int) (*Playlist, error) {
+	playlist := &Playlist{}
+	err := d.conn().Where("id=?", id).Find(playlist).Error
+	return playlist, err
+}
+
+func (d *gormDataStore) GetPlaylistsByUser(userID int) ([]*Playlist, error) {
+	var playlists []*Playlist
+	err := d.conn().Where("user_id=?", userID).Find(&playlists).Error
+	return playlists, err
+}
+
+func (d *gormDataStore) GetOrCreatePlaylist(id int) (*Playlist, error) {
+	playlist := &Playlist{}
+	err := d.conn().Where("id=?", id).FirstOrCreate(playlist).Error
+	return playlist, err
+}
+
+func (d *gormDataStore) SavePlaylist(playlist *Playlist) error {
+	return d.conn().Save(playlist).Error
+}
+
+func (d *gormDataStore) DeletePlaylist(id int) error {
+	return d.conn().Where("id=?", id).Delete(&Playlist{}).Error
+}
+
+func (d *gormDataStore) GetPlayQueue(userID int) (*PlayQueue, error) {
+	queue := &PlayQueue{UserID: userID}
+	err := d.conn().Where(queue).First(queue).Error
+	return queue, err
+}
+
+func (d *gormDataStore) SavePlayQueue(queue *PlayQueue) error {
+	return d.conn().Save(queue).Error
+}
+
+func (d *gormDataStore) GetProperty(key string) string {
+	return d.db.GetSetting(key)
+}
+
+func (d *gormDataStore) SetProperty(key, value string) error {
+	return d.db.SetSetting(key, value)
+}
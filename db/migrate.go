@@ -0,0 +1,79 @@
+package db
+
+import "github.com/jinzhu/gorm"
+
+// Migrate brings the schema up to date. It's called once at startup, before
+// any DataStore is handed out to the scanner or the controller, so it works
+// against the raw connection rather than going through the repositories.
+func Migrate(gdb *DB) error {
+	gdb.Exec("PRAGMA foreign_keys = ON")
+	tx := gdb.Begin()
+	defer tx.Commit()
+	tx.AutoMigrate(
+		MusicFolder{},
+		Album{},
+		AlbumArtist{},
+		Track{},
+		Cover{},
+		User{},
+		Setting{},
+		Play{},
+		Folder{},
+		Playlist{},
+		PlaylistTrack{},
+	)
+	tx.FirstOrCreate(&User{}, User{
+		Name:     "admin",
+		Password: "admin",
+		IsAdmin:  true,
+	})
+	if err := migratePlaylistBlobs(tx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// migratedPlaylistBlobsKey marks that migratePlaylistBlobs has already
+// run, so it can be told apart from a playlist that's legitimately empty.
+// Checking count(playlist_tracks) == 0 instead would resurrect every
+// track a user removed through ServeUpdatePlaylist's remove path the next
+// time the server restarts.
+const migratedPlaylistBlobsKey = "migrated_playlist_tracks"
+
+// migratePlaylistBlobs splits each playlist's legacy comma-separated
+// Items blob into rows in the new playlist_tracks table. It runs at most
+// once, guarded by migratedPlaylistBlobsKey, and clears Items once split
+// so nothing can read the stale blob afterwards.
+func migratePlaylistBlobs(tx *gorm.DB) error {
+	var marker Setting
+	err := tx.Where("key = ?", migratedPlaylistBlobsKey).First(&marker).Error
+	if err == nil {
+		return nil
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+	var playlists []*Playlist
+	if err := tx.Find(&playlists).Error; err != nil {
+		return err
+	}
+	for _, playlist := range playlists {
+		if playlist.Items == "" {
+			continue
+		}
+		for position, trackID := range playlist.GetItems() {
+			if err := tx.Save(&PlaylistTrack{
+				PlaylistID: playlist.ID,
+				TrackID:    trackID,
+				Position:   position,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		playlist.Items = ""
+		if err := tx.Save(playlist).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Save(&Setting{Key: migratedPlaylistBlobsKey, Value: "true"}).Error
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// DB wraps a *gorm.DB, adding typed access to the free-form settings table
+// so callers (GetSetting/SetSetting) don't need to hand-roll queries
+// against it themselves. Everything else goes through gormDataStore.
+type DB struct {
+	*gorm.DB
+}
+
+// GetSetting returns the value stored under key, or "" if it's never been set.
+func (d *DB) GetSetting(key string) string {
+	setting := &Setting{}
+	d.Where("key = ?", key).First(setting)
+	return setting.Value
+}
+
+// SetSetting creates or updates the value stored under key.
+func (d *DB) SetSetting(key, value string) error {
+	setting := &Setting{}
+	d.Where("key = ?", key).FirstOrInit(setting, Setting{Key: key})
+	setting.Value = value
+	return d.Save(setting).Error
+}
+
+// MusicFolder is one configured library root - what Subsonic calls a
+// "music folder". Every Folder, Album, Track, and Cover row is scoped to
+// the library it was scanned from by LibraryID.
+type MusicFolder struct {
+	ID   int `gorm:"primary_key"`
+	Name string
+	Path string
+}
+
+// Folder is a row in the folder tree used for Subsonic's "browse by
+// folder" views. ParentID chains folders back up to their library's root.
+type Folder struct {
+	ID        int `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	LibraryID int
+	ParentID  int
+	CoverID   int
+	Path      string
+	Name      string
+	HasTracks bool
+}
+
+// Cover is a cover image found alongside tracks or an album, keyed by the
+// path it was read from.
+type Cover struct {
+	ID        int `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	LibraryID int
+	Path      string
+	Image     []byte
+
+	// NewlyInserted is set (never persisted) when handleCover reads a
+	// fresh image from disk, so handleFolderCompletion knows to point the
+	// current folder at it.
+	NewlyInserted bool `gorm:"-"`
+}
+
+// AlbumArtist is an artist as credited on an album, deduplicated by name
+// during a scan and re-keyed onto MusicBrainzID by `gonic use_mbzid`.
+type AlbumArtist struct {
+	ID            int `gorm:"primary_key"`
+	Name          string
+	MusicBrainzID string
+}
+
+// Album groups every track found under one directory. The tag_* columns
+// live on the album so the getAlbumList2 filter strategies can sort and
+// filter without joining back to tracks. The scanner fills tag_title and
+// tag_year from the first track it finds; it does not set tag_artist or
+// tag_genre.
+type Album struct {
+	ID            int `gorm:"primary_key"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	LibraryID     int
+	Path          string
+	CoverID       int
+	Cover         *Cover
+	AlbumArtistID int
+	AlbumArtist   *AlbumArtist
+	MusicBrainzID string
+	PlayCount     int
+	StarredAt     *time.Time
+
+	Title  string `gorm:"column:tag_title"`
+	Artist string `gorm:"column:tag_artist"`
+	Genre  string `gorm:"column:tag_genre"`
+	Year   int    `gorm:"column:tag_year"`
+	Rating int
+}
+
+// Track is a single scanned audio file.
+type Track struct {
+	ID            int `gorm:"primary_key"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	LibraryID     int
+	FolderID      int
+	AlbumID       int
+	Album         *Album
+	AlbumArtistID int
+	Path          string
+	Title         string
+	Artist        string
+	Artists       string
+	DiscNumber    int
+	DiscSubtitle  string
+	TotalDiscs    int
+	TrackNumber   int
+	TotalTracks   int
+	Year          int
+	Suffix        string
+	ContentType   string
+	Size          int
+	MusicBrainzID string
+
+	ReplayGainTrackGain float64
+	ReplayGainTrackPeak float64
+	ReplayGainAlbumGain float64
+	ReplayGainAlbumPeak float64
+}
+
+// User is a Subsonic API user.
+type User struct {
+	ID            int `gorm:"primary_key"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	Name          string
+	Password      string
+	IsAdmin       bool
+	LastFMSession string
+}
+
+// Setting is a single key/value row in gonic's free-form settings table -
+// see DB.GetSetting/SetSetting.
+type Setting struct {
+	Key   string `gorm:"primary_key"`
+	Value string
+}
+
+// Play records one last.fm scrobble, so a resubmission of the same play
+// can be told apart from a new one.
+type Play struct {
+	ID      int `gorm:"primary_key"`
+	UserID  int
+	TrackID int
+	Time    time.Time
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PlayQueue is a user's saved play queue position, carried across clients.
+// Items is the same comma-separated track ID blob Playlist used before
+// playlist_tracks - a play queue is always read and replaced wholesale, so
+// there's no need for an ordered table here too.
+type PlayQueue struct {
+	ID        int `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	UserID    int
+	Current   int
+	Position  int
+	ChangedBy string
+	Items     string
+}
+
+// GetItems parses the comma-separated Items blob.
+func (q *PlayQueue) GetItems() []int {
+	if q.Items == "" {
+		return nil
+	}
+	parts := strings.Split(q.Items, ",")
+	ids := make([]int, 0, len(parts))
+	for _, part := range parts {
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// SetItems encodes ids as the comma-separated Items blob.
+func (q *PlayQueue) SetItems(ids []int) {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id)
+	}
+	q.Items = strings.Join(parts, ",")
+}
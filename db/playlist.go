@@ -0,0 +1,51 @@
+package db
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Playlist is a user-curated, or smart (see Rules), ordered list of
+// tracks. Manual membership lives in the playlist_tracks table - see
+// GetPlaylistWithTracks - a smart playlist has none of its own and is
+// materialized on the fly from Rules instead.
+type Playlist struct {
+	ID         int `gorm:"primary_key"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	UserID     int
+	Name       string
+	Comment    string
+	TrackCount int
+	// Items is the legacy comma-separated track ID blob. It's only read
+	// once, by migratePlaylistBlobs, to seed playlist_tracks.
+	Items string
+	// Rules holds a JSON-encoded playlist/smart.Rules tree when this is a
+	// smart playlist. Empty for a normal, manually curated playlist.
+	Rules string
+}
+
+// IsSmart reports whether the playlist is rule-based rather than manually
+// curated.
+func (p *Playlist) IsSmart() bool {
+	return p.Rules != ""
+}
+
+// GetItems parses the legacy Items blob. It exists only to support
+// migratePlaylistBlobs; new code should go through playlist_tracks.
+func (p *Playlist) GetItems() []int {
+	if p.Items == "" {
+		return nil
+	}
+	parts := strings.Split(p.Items, ",")
+	ids := make([]int, 0, len(parts))
+	for _, part := range parts {
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
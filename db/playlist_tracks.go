@@ -0,0 +1,83 @@
+package db
+
+import "senan.xyz/g/gonic/playlist/smart"
+
+// PlaylistTrack is one ordered row of a playlist, replacing the old
+// comma-separated Playlist.Items blob. Keeping track membership as real
+// rows means callers can load a playlist's tracks with a single JOIN
+// instead of one query per track, and lets us support inserting or
+// reordering a single track without rewriting the whole list.
+type PlaylistTrack struct {
+	ID         int `gorm:"primary_key"`
+	PlaylistID int
+	TrackID    int
+	Position   int
+}
+
+func (d *gormDataStore) GetPlaylistWithTracks(id int) (*Playlist, []*Track, error) {
+	playlist, err := d.GetPlaylist(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	var tracks []*Track
+	err = d.conn().
+		Joins("JOIN playlist_tracks ON playlist_tracks.track_id = tracks.id").
+		Where("playlist_tracks.playlist_id = ?", id).
+		Order("playlist_tracks.position").
+		Preload("Album").
+		Find(&tracks).
+		Error
+	return playlist, tracks, err
+}
+
+// SetPlaylistTracks replaces a playlist's track list wholesale, in the
+// order given. It's the path ServeUpdatePlaylist uses when removing tracks
+// by index (with any added tracks appended); a pure add goes through
+// InsertPlaylistTrack instead.
+func (d *gormDataStore) SetPlaylistTracks(playlistID int, trackIDs []int) error {
+	conn := d.conn()
+	if err := conn.Where("playlist_id = ?", playlistID).Delete(&PlaylistTrack{}).Error; err != nil {
+		return err
+	}
+	for position, trackID := range trackIDs {
+		row := &PlaylistTrack{PlaylistID: playlistID, TrackID: trackID, Position: position}
+		if err := conn.Save(row).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertPlaylistTrack inserts a track at position, shifting every row at
+// or after it down by one.
+func (d *gormDataStore) InsertPlaylistTrack(playlistID, trackID, position int) error {
+	conn := d.conn()
+	if err := conn.Exec(`
+        UPDATE playlist_tracks
+        SET    position = position + 1
+        WHERE  playlist_id = ? AND position >= ?
+    `, playlistID, position).Error; err != nil {
+		return err
+	}
+	return conn.Save(&PlaylistTrack{
+		PlaylistID: playlistID,
+		TrackID:    trackID,
+		Position:   position,
+	}).Error
+}
+
+// GetSmartPlaylistTracks runs a compiled smart playlist query against
+// tracks joined with albums, materializing membership on the fly instead
+// of reading playlist_tracks.
+func (d *gormDataStore) GetSmartPlaylistTracks(q *smart.Query) ([]*Track, error) {
+	var tracks []*Track
+	err := d.conn().
+		Joins("JOIN albums ON tracks.album_id = albums.id").
+		Where(q.Where, q.Args...).
+		Order(q.Sort + " " + q.Order).
+		Limit(q.Limit).
+		Preload("Album").
+		Find(&tracks).
+		Error
+	return tracks, err
+}
@@ -0,0 +1,208 @@
+// Package smart compiles a saved-query rule tree into the parameterized
+// WHERE / ORDER BY / LIMIT a smart db.Playlist is materialized with. The
+// tree itself is stored as JSON in Playlist.Rules; ServeGetPlaylist
+// compiles it and runs the result against tracks joined with albums
+// instead of reading stored membership.
+package smart
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Op is a comparison operator a single rule can use.
+type Op string
+
+const (
+	OpIs       Op = "is"
+	OpIsNot    Op = "isNot"
+	OpContains Op = "contains"
+	OpGT       Op = "gt"
+	OpLT       Op = "lt"
+	// OpInLastPrefix rules are named "inLast<days>", eg. "inLast30" for
+	// "in the last 30 days" - there's no separate day field, since this
+	// keeps the rule a plain {field, op, value} triple like every other.
+	OpInLastPrefix = "inLast"
+)
+
+// Field is a comparable column a rule can test. Fields are named after
+// the Subsonic-ish vocabulary a client would show in a rule builder, and
+// mapped to their real SQL column in columnFor.
+type Field string
+
+const (
+	FieldArtist     Field = "artist"
+	FieldYear       Field = "year"
+	FieldPlayCount  Field = "play_count"
+	FieldRating     Field = "rating"
+	FieldLastPlayed Field = "last_played"
+	FieldGenre      Field = "genre"
+)
+
+func columnFor(f Field) (string, bool) {
+	switch f {
+	case FieldArtist:
+		return "albums.tag_artist", true
+	case FieldYear:
+		return "albums.tag_year", true
+	case FieldPlayCount:
+		return "tracks.play_count", true
+	case FieldRating:
+		return "tracks.rating", true
+	case FieldLastPlayed:
+		return "tracks.last_played_at", true
+	case FieldGenre:
+		return "albums.tag_genre", true
+	default:
+		return "", false
+	}
+}
+
+// Comparison is a single leaf rule, eg. {Field: "year", Op: "gt", Value: "2000"}.
+type Comparison struct {
+	Field Field  `json:"field"`
+	Op    Op     `json:"op"`
+	Value string `json:"value"`
+}
+
+// Group is a boolean combination of comparisons and/or nested groups.
+// Comparisons, And, Or and Not may be set in any combination; the clause
+// each one compiles to is AND-ed with the others.
+type Group struct {
+	Comparisons []Comparison `json:"comparisons,omitempty"`
+	And         []Group      `json:"and,omitempty"`
+	Or          []Group      `json:"or,omitempty"`
+	Not         *Group       `json:"not,omitempty"`
+}
+
+// Rules is the root of a saved smart playlist query, stored as
+// db.Playlist.Rules.
+type Rules struct {
+	Root  Group  `json:"root"`
+	Sort  Field  `json:"sort"`
+	Order string `json:"order"` // "asc" or "desc", defaults to "asc"
+	Limit int    `json:"limit"`
+}
+
+// Query is what Compile produces: a parameterized WHERE clause, plus the
+// ORDER BY / LIMIT to run it with.
+type Query struct {
+	Where string
+	Args  []interface{}
+	Sort  string
+	Order string
+	Limit int
+}
+
+// ErrNoLimit is returned by Compile when Rules doesn't set a Limit. Smart
+// playlists always require one so a broad rule set (or an empty one)
+// can't materialize the whole library on every getPlaylist call.
+var ErrNoLimit = errors.New("smart playlist rules must set a limit")
+
+// Compile turns r into a Query ready to run against tracks joined with
+// albums.
+func Compile(r Rules) (*Query, error) {
+	if r.Limit <= 0 {
+		return nil, ErrNoLimit
+	}
+	where, args, err := compileGroup(r.Root)
+	if err != nil {
+		return nil, err
+	}
+	if where == "" {
+		where = "1=1"
+	}
+	order := strings.ToLower(r.Order)
+	if order != "asc" && order != "desc" {
+		order = "asc"
+	}
+	sort, ok := columnFor(r.Sort)
+	if !ok {
+		sort = "albums.tag_artist"
+	}
+	return &Query{Where: where, Args: args, Sort: sort, Order: order, Limit: r.Limit}, nil
+}
+
+func compileGroup(g Group) (string, []interface{}, error) {
+	var clauses []string
+	var args []interface{}
+	for _, c := range g.Comparisons {
+		clause, carg, err := compileComparison(c)
+		if err != nil {
+			return "", nil, err
+		}
+		clauses = append(clauses, clause)
+		args = append(args, carg...)
+	}
+	if len(g.And) > 0 {
+		clause, cargs, err := compileJoin(g.And, "AND")
+		if err != nil {
+			return "", nil, err
+		}
+		clauses = append(clauses, clause)
+		args = append(args, cargs...)
+	}
+	if len(g.Or) > 0 {
+		clause, cargs, err := compileJoin(g.Or, "OR")
+		if err != nil {
+			return "", nil, err
+		}
+		clauses = append(clauses, clause)
+		args = append(args, cargs...)
+	}
+	if g.Not != nil {
+		clause, cargs, err := compileGroup(*g.Not)
+		if err != nil {
+			return "", nil, err
+		}
+		clauses = append(clauses, fmt.Sprintf("NOT (%s)", clause))
+		args = append(args, cargs...)
+	}
+	if len(clauses) == 0 {
+		return "", nil, nil
+	}
+	return "(" + strings.Join(clauses, " AND ") + ")", args, nil
+}
+
+func compileJoin(groups []Group, joiner string) (string, []interface{}, error) {
+	var clauses []string
+	var args []interface{}
+	for _, g := range groups {
+		clause, cargs, err := compileGroup(g)
+		if err != nil {
+			return "", nil, err
+		}
+		clauses = append(clauses, clause)
+		args = append(args, cargs...)
+	}
+	return "(" + strings.Join(clauses, " "+joiner+" ") + ")", args, nil
+}
+
+func compileComparison(c Comparison) (string, []interface{}, error) {
+	col, ok := columnFor(c.Field)
+	if !ok {
+		return "", nil, fmt.Errorf("smart playlist: unknown field %q", c.Field)
+	}
+	switch {
+	case c.Op == OpIs:
+		return col + " = ?", []interface{}{c.Value}, nil
+	case c.Op == OpIsNot:
+		return col + " != ?", []interface{}{c.Value}, nil
+	case c.Op == OpContains:
+		return col + " LIKE ?", []interface{}{"%" + c.Value + "%"}, nil
+	case c.Op == OpGT:
+		return col + " > ?", []interface{}{c.Value}, nil
+	case c.Op == OpLT:
+		return col + " < ?", []interface{}{c.Value}, nil
+	case strings.HasPrefix(string(c.Op), OpInLastPrefix):
+		days, err := strconv.Atoi(strings.TrimPrefix(string(c.Op), OpInLastPrefix))
+		if err != nil {
+			return "", nil, fmt.Errorf("smart playlist: bad op %q", c.Op)
+		}
+		return fmt.Sprintf("%s >= datetime('now', '-%d days')", col, days), nil, nil
+	default:
+		return "", nil, fmt.Errorf("smart playlist: unknown op %q", c.Op)
+	}
+}
@@ -0,0 +1,67 @@
+package smart
+
+import "testing"
+
+func TestCompileNoLimit(t *testing.T) {
+	_, err := Compile(Rules{})
+	if err != ErrNoLimit {
+		t.Fatalf("expected ErrNoLimit, got %v", err)
+	}
+}
+
+func TestCompileSimple(t *testing.T) {
+	q, err := Compile(Rules{
+		Root: Group{
+			Comparisons: []Comparison{
+				{Field: FieldYear, Op: OpGT, Value: "2000"},
+			},
+		},
+		Sort:  FieldYear,
+		Order: "desc",
+		Limit: 50,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "(albums.tag_year > ?)"; q.Where != want {
+		t.Errorf("where = %q, want %q", q.Where, want)
+	}
+	if len(q.Args) != 1 || q.Args[0] != "2000" {
+		t.Errorf("args = %v, want [2000]", q.Args)
+	}
+	if q.Sort != "albums.tag_year" || q.Order != "desc" || q.Limit != 50 {
+		t.Errorf("unexpected query shape: %+v", q)
+	}
+}
+
+func TestCompileAndOr(t *testing.T) {
+	q, err := Compile(Rules{
+		Root: Group{
+			And: []Group{
+				{Comparisons: []Comparison{{Field: FieldGenre, Op: OpIs, Value: "rock"}}},
+			},
+			Or: []Group{
+				{Comparisons: []Comparison{{Field: FieldArtist, Op: OpContains, Value: "foo"}}},
+			},
+		},
+		Limit: 10,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(q.Args) != 2 {
+		t.Errorf("args = %v, want 2 values", q.Args)
+	}
+}
+
+func TestCompileUnknownField(t *testing.T) {
+	_, err := Compile(Rules{
+		Root: Group{
+			Comparisons: []Comparison{{Field: "nonsense", Op: OpIs, Value: "x"}},
+		},
+		Limit: 10,
+	})
+	if err == nil {
+		t.Fatal("expected an error for an unknown field")
+	}
+}
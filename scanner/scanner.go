@@ -12,6 +12,10 @@ package scanner
 //        -> needs a  ParentID
 // Track  -> needs an AlbumID
 //        -> needs a  FolderID
+//
+// since a server can have more than one music folder configured, every one
+// of the above also needs a LibraryID so that browsing and scanning stay
+// scoped to the library they came from
 
 import (
 	"fmt"
@@ -19,6 +23,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -26,20 +31,28 @@ import (
 	"github.com/karrick/godirwalk"
 	"github.com/pkg/errors"
 
-	"github.com/sentriz/gonic/model"
+	"senan.xyz/g/gonic/db"
+	"senan.xyz/g/gonic/tags"
 )
 
 var (
 	IsScanning int32
 )
 
+// Scanner walks every configured library in turn. library-scoped state
+// (seen paths, the current folder stack, the in-flight cover/album) is
+// reset between libraries so that records from one can never leak into
+// another. All database access goes through a db.DataStore rather than
+// GORM directly, so a whole walk runs inside a single ds.WithTx call.
 type Scanner struct {
-	db        *gorm.DB
-	tx        *gorm.DB
-	musicPath string
+	ds        db.DataStore
+	tx        db.DataStore
+	libraries []*db.MusicFolder
+	// currentLibrary is the library we're presently walking
+	currentLibrary *db.MusicFolder
 	// seenPaths is used to keep every path we've seen so that
-	// we can remove old tracks, folders, and covers by path when we
-	// are in the cleanDatabase stage
+	// we can remove old tracks by path when we are in the cleanup stage.
+	// reset per library.
 	seenPaths map[string]bool
 	// currentDirStack is used for inserting to the folders (subsonic browse
 	// by folder) which helps us work out a folder's parent
@@ -47,74 +60,83 @@ type Scanner struct {
 	// currentCover because we find a cover anywhere among the tracks during the
 	// walk and need a reference to it when we update folder and album records
 	// when we exit a folder
-	currentCover *model.Cover
+	currentCover *db.Cover
 	// currentAlbum because we update this record when we exit a folder with
 	// our new reference to it's cover
-	currentAlbum *model.Album
+	currentAlbum *db.Album
 }
 
-func New(db *gorm.DB, musicPath string) *Scanner {
+func New(ds db.DataStore, libraries []*db.MusicFolder) *Scanner {
 	return &Scanner{
-		db:              db,
-		musicPath:       musicPath,
-		seenPaths:       make(map[string]bool),
-		currentDirStack: make(dirStack, 0),
-		currentCover:    &model.Cover{},
-		currentAlbum:    &model.Album{},
+		ds:        ds,
+		libraries: libraries,
 	}
 }
 
-func (s *Scanner) updateAlbum(fullPath string, album *model.Album) {
+func (s *Scanner) resetLibraryState() {
+	s.seenPaths = make(map[string]bool)
+	s.currentDirStack = make(dirStack, 0)
+	s.currentCover = &db.Cover{}
+	s.currentAlbum = &db.Album{}
+}
+
+func (s *Scanner) updateAlbum(fullPath string, album *db.Album) error {
 	if s.currentAlbum.ID != 0 {
-		return
+		return nil
 	}
 	directory, _ := path.Split(fullPath)
 	// update album table (the currentAlbum record will be updated when
 	// we exit this folder)
-	err := s.tx.Where("path = ?", directory).First(s.currentAlbum).Error
+	found, err := s.tx.GetAlbumByPath(directory, s.currentLibrary.ID)
 	if !gorm.IsRecordNotFoundError(err) {
 		// we found the record
 		// TODO: think about mod time here
-		return
+		s.currentAlbum = found
+		return err
 	}
-	s.currentAlbum = &model.Album{
+	s.currentAlbum = &db.Album{
 		Path:          directory,
 		Title:         album.Title,
 		AlbumArtistID: album.AlbumArtistID,
 		Year:          album.Year,
+		LibraryID:     s.currentLibrary.ID,
+		MusicBrainzID: album.MusicBrainzID,
 	}
-	s.tx.Save(s.currentAlbum)
+	return s.tx.SaveAlbum(s.currentAlbum)
 }
 
 func (s *Scanner) handleCover(fullPath string, stat os.FileInfo) error {
 	modTime := stat.ModTime()
-	err := s.tx.Where("path = ?", fullPath).First(s.currentCover).Error
-	if !gorm.IsRecordNotFoundError(err) &&
-		modTime.Before(s.currentCover.UpdatedAt) {
-		// we found the record but it hasn't changed
-		return nil
+	found, err := s.tx.GetCoverByPath(fullPath, s.currentLibrary.ID)
+	if !gorm.IsRecordNotFoundError(err) {
+		if modTime.Before(found.UpdatedAt) {
+			// we found the record but it hasn't changed
+			s.currentCover = found
+			return nil
+		}
 	}
 	image, err := ioutil.ReadFile(fullPath)
 	if err != nil {
 		return fmt.Errorf("when reading cover: %v", err)
 	}
-	s.currentCover = &model.Cover{
+	s.currentCover = &db.Cover{
 		Path:          fullPath,
 		Image:         image,
 		NewlyInserted: true,
+		LibraryID:     s.currentLibrary.ID,
 	}
-	s.tx.Save(s.currentCover)
-	return nil
+	return s.tx.SaveCover(s.currentCover)
 }
 
 func (s *Scanner) handleFolder(fullPath string, stat os.FileInfo) error {
 	// update folder table for browsing by folder
-	folder := &model.Folder{}
+	folder, err := s.tx.GetFolderByPath(fullPath, s.currentLibrary.ID)
+	if gorm.IsRecordNotFoundError(err) {
+		folder = &db.Folder{}
+	}
 	defer s.currentDirStack.Push(folder)
 	modTime := stat.ModTime()
-	err := s.tx.Where("path = ?", fullPath).First(folder).Error
-	if !gorm.IsRecordNotFoundError(err) &&
-		modTime.Before(folder.UpdatedAt) {
+	if err == nil && modTime.Before(folder.UpdatedAt) {
 		// we found the record but it hasn't changed
 		return nil
 	}
@@ -122,8 +144,8 @@ func (s *Scanner) handleFolder(fullPath string, stat os.FileInfo) error {
 	folder.Path = fullPath
 	folder.ParentID = s.currentDirStack.PeekID()
 	folder.Name = folderName
-	s.tx.Save(folder)
-	return nil
+	folder.LibraryID = s.currentLibrary.ID
+	return s.tx.SaveFolder(folder)
 }
 
 func (s *Scanner) handleFolderCompletion(fullPath string, info *godirwalk.Dirent) error {
@@ -132,7 +154,7 @@ func (s *Scanner) handleFolderCompletion(fullPath string, info *godirwalk.Dirent
 	var dirShouldSave bool
 	if s.currentAlbum.ID != 0 {
 		s.currentAlbum.CoverID = s.currentCover.ID
-		s.tx.Save(s.currentAlbum)
+		s.tx.SaveAlbum(s.currentAlbum)
 		currentDir.HasTracks = true
 		dirShouldSave = true
 	}
@@ -141,10 +163,10 @@ func (s *Scanner) handleFolderCompletion(fullPath string, info *godirwalk.Dirent
 		dirShouldSave = true
 	}
 	if dirShouldSave {
-		s.tx.Save(currentDir)
+		s.tx.SaveFolder(currentDir)
 	}
-	s.currentCover = &model.Cover{}
-	s.currentAlbum = &model.Album{}
+	s.currentCover = &db.Cover{}
+	s.currentAlbum = &db.Album{}
 	log.Printf("processed folder `%s`\n", fullPath)
 	return nil
 }
@@ -152,56 +174,63 @@ func (s *Scanner) handleFolderCompletion(fullPath string, info *godirwalk.Dirent
 func (s *Scanner) handleTrack(fullPath string, stat os.FileInfo, mime, exten string) error {
 	//
 	// set track basics
-	track := &model.Track{}
+	track, err := s.tx.GetTrackByPath(fullPath, s.currentLibrary.ID)
+	if gorm.IsRecordNotFoundError(err) {
+		track = &db.Track{}
+	}
 	modTime := stat.ModTime()
-	err := s.tx.Where("path = ?", fullPath).First(track).Error
-	if !gorm.IsRecordNotFoundError(err) &&
-		modTime.Before(track.UpdatedAt) {
+	if err == nil && modTime.Before(track.UpdatedAt) {
 		// we found the record but it hasn't changed
 		return nil
 	}
-	tags, err := readTags(fullPath)
+	tg, err := tags.Read(fullPath)
 	if err != nil {
 		return fmt.Errorf("when reading tags: %v", err)
 	}
-	trackNumber, totalTracks := tags.Track()
-	discNumber, totalDiscs := tags.Disc()
+	trackNumber, totalTracks := tg.Track()
+	discNumber, totalDiscs := tg.Disc()
 	track.Path = fullPath
-	track.Title = tags.Title()
-	track.Artist = tags.Artist()
+	track.Title = tg.Title()
+	track.Artist = tg.Artist()
+	track.Artists = strings.Join(tg.Artists(), "; ")
 	track.DiscNumber = discNumber
+	track.DiscSubtitle = tg.DiscSubtitle()
 	track.TotalDiscs = totalDiscs
 	track.TotalTracks = totalTracks
 	track.TrackNumber = trackNumber
-	track.Year = tags.Year()
+	track.Year = tg.Year()
 	track.Suffix = exten
 	track.ContentType = mime
 	track.Size = int(stat.Size())
 	track.FolderID = s.currentDirStack.PeekID()
+	track.LibraryID = s.currentLibrary.ID
+	track.MusicBrainzID = tg.MusicBrainzTrackID()
+	track.ReplayGainTrackGain = tg.ReplayGainTrackGain()
+	track.ReplayGainTrackPeak = tg.ReplayGainTrackPeak()
+	track.ReplayGainAlbumGain = tg.ReplayGainAlbumGain()
+	track.ReplayGainAlbumPeak = tg.ReplayGainAlbumPeak()
 	//
 	// set album artist basics
-	albumArtist := &model.AlbumArtist{}
-	err = s.tx.Where("name = ?", tags.AlbumArtist()).
-		First(albumArtist).
-		Error
-	if gorm.IsRecordNotFoundError(err) {
-		albumArtist.Name = tags.AlbumArtist()
-		s.tx.Save(albumArtist)
+	albumArtist, err := s.tx.GetOrCreateAlbumArtist(tg.AlbumArtist(), tg.MusicBrainzAlbumArtistID())
+	if err != nil {
+		return fmt.Errorf("when getting album artist: %v", err)
 	}
 	track.AlbumArtistID = albumArtist.ID
 	//
 	// set temporary album's basics - will be updated with
 	// cover after the tracks inserted when we exit the folder
-	s.updateAlbum(fullPath, &model.Album{
+	if err := s.updateAlbum(fullPath, &db.Album{
 		AlbumArtistID: albumArtist.ID,
-		Title:         tags.Album(),
-		Year:          tags.Year(),
-	})
+		Title:         tg.Album(),
+		Year:          tg.Year(),
+		MusicBrainzID: tg.MusicBrainzAlbumID(),
+	}); err != nil {
+		return fmt.Errorf("when updating album: %v", err)
+	}
 	//
 	// update the track with our new album and finally save
 	track.AlbumID = s.currentAlbum.ID
-	s.tx.Save(track)
-	return nil
+	return s.tx.SaveTrack(track)
 }
 
 func (s *Scanner) handleItem(fullPath string, info *godirwalk.Dirent) error {
@@ -222,75 +251,75 @@ func (s *Scanner) handleItem(fullPath string, info *godirwalk.Dirent) error {
 	return nil
 }
 
-func (s *Scanner) MigrateDB() error {
-	defer logElapsed(time.Now(), "migrating database")
-	s.db.Exec("PRAGMA foreign_keys = ON")
-	s.tx = s.db.Begin()
-	defer s.tx.Commit()
-	s.tx.AutoMigrate(
-		model.Album{},
-		model.AlbumArtist{},
-		model.Track{},
-		model.Cover{},
-		model.User{},
-		model.Setting{},
-		model.Play{},
-		model.Folder{},
-	)
-	s.tx.FirstOrCreate(&model.User{}, model.User{
-		Name:     "admin",
-		Password: "admin",
-		IsAdmin:  true,
-	})
-	return nil
+// lastScanKey is the setting key a library's last full scan time is stored
+// under, so that `ifModifiedSince` queries can be answered per-folder
+// instead of for the whole server.
+func lastScanKey(libraryID int) string {
+	return fmt.Sprintf("last_scan_%d", libraryID)
 }
 
-func (s *Scanner) Start() error {
-	if atomic.LoadInt32(&IsScanning) == 1 {
-		return errors.New("already scanning")
+// LastScan returns the time the given library was last fully scanned, or
+// the zero time if it's never been scanned.
+func (s *Scanner) LastScan(libraryID int) time.Time {
+	raw := s.ds.GetProperty(lastScanKey(libraryID))
+	if raw == "" {
+		return time.Time{}
 	}
-	atomic.StoreInt32(&IsScanning, 1)
-	defer atomic.StoreInt32(&IsScanning, 0)
-	defer logElapsed(time.Now(), "scanning")
-	s.db.Exec("PRAGMA foreign_keys = ON")
-	s.tx = s.db.Begin()
-	defer s.tx.Commit()
-	//
-	// start scan logic
-	err := godirwalk.Walk(s.musicPath, &godirwalk.Options{
+	stamp, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}
+	}
+	return stamp
+}
+
+// walkLibrary performs a single unsorted walk of one configured library,
+// scoping every record it touches to that library's ID. It must be called
+// with s.tx already bound to the transaction for this library.
+func (s *Scanner) walkLibrary(library *db.MusicFolder) error {
+	s.currentLibrary = library
+	s.resetLibraryState()
+	err := godirwalk.Walk(library.Path, &godirwalk.Options{
 		Callback:             s.handleItem,
 		PostChildrenCallback: s.handleFolderCompletion,
 		Unsorted:             true,
 	})
 	if err != nil {
-		return errors.Wrap(err, "walking filesystem")
+		return errors.Wrapf(err, "walking library `%s`", library.Name)
+	}
+	// cleaning logic, scoped to this library only
+	log.Printf("cleaning database for library `%s`\n", library.Name)
+	tracks, err := s.tx.ListTrackPaths(library.ID)
+	if err != nil {
+		return errors.Wrap(err, "listing track paths")
 	}
-	//
-	// start cleaning logic
-	log.Println("cleaning database")
-	var tracks []*model.Track
-	s.tx.Select("id, path").Find(&tracks)
 	for _, track := range tracks {
-		_, ok := s.seenPaths[track.Path]
-		if ok {
+		if s.seenPaths[track.Path] {
 			continue
 		}
-		s.tx.Delete(&track)
+		s.tx.DeleteTrack(track)
 		log.Println("removed", track.Path)
 	}
-	// delete albums without tracks
-	s.tx.Exec(`
-        DELETE FROM albums
-        WHERE  (SELECT count(id)
-                FROM   tracks
-                WHERE  album_id = albums.id) = 0;
-       `)
-	// delete artists without tracks
-	s.tx.Exec(`
-        DELETE FROM album_artists
-        WHERE  (SELECT count(id)
-                FROM   albums
-                WHERE  album_artist_id = album_artists.id) = 0;
-    `)
+	if err := s.tx.CleanupLibrary(library.ID); err != nil {
+		return errors.Wrap(err, "cleaning up library")
+	}
+	return s.tx.SetProperty(lastScanKey(library.ID), time.Now().Format(time.RFC3339))
+}
+
+func (s *Scanner) Start() error {
+	if atomic.LoadInt32(&IsScanning) == 1 {
+		return errors.New("already scanning")
+	}
+	atomic.StoreInt32(&IsScanning, 1)
+	defer atomic.StoreInt32(&IsScanning, 0)
+	defer logElapsed(time.Now(), "scanning")
+	for _, library := range s.libraries {
+		err := s.ds.WithTx(func(tx db.DataStore) error {
+			s.tx = tx
+			return s.walkLibrary(library)
+		})
+		if err != nil {
+			return err
+		}
+	}
 	return nil
-}
\ No newline at end of file
+}
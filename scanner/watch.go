@@ -0,0 +1,203 @@
+package scanner
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jinzhu/gorm"
+	"github.com/karrick/godirwalk"
+	"github.com/pkg/errors"
+
+	"senan.xyz/g/gonic/db"
+)
+
+// debounceWindow is how long a directory must go quiet before we rescan it.
+// bursts of events (eg. an editor doing a save-as, or a sync tool writing
+// a whole album) are coalesced into a single rescan instead of one per event.
+const debounceWindow = 5 * time.Second
+
+// Watcher observes a Scanner's configured libraries for filesystem changes
+// and triggers targeted rescans of just the affected directories, instead
+// of the full godirwalk.Walk that Scanner.Start does.
+type Watcher struct {
+	scanner *Scanner
+	fsw     *fsnotify.Watcher
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+}
+
+// NewWatcher sets up recursive watches on every one of scanner's configured
+// libraries. It doesn't start consuming events until Start is called.
+func NewWatcher(s *Scanner) (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("creating fsnotify watcher: %v", err)
+	}
+	w := &Watcher{
+		scanner: s,
+		fsw:     fsw,
+		pending: make(map[string]*time.Timer),
+	}
+	for _, library := range s.libraries {
+		if err := w.addRecursive(library); err != nil {
+			fsw.Close()
+			return nil, fmt.Errorf("watching library `%s`: %v", library.Name, err)
+		}
+	}
+	return w, nil
+}
+
+func (w *Watcher) addRecursive(library *db.MusicFolder) error {
+	return filepath.Walk(library.Path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		return w.fsw.Add(p)
+	})
+}
+
+// Start blocks, dispatching debounced rescans as events arrive. Run it in
+// its own goroutine alongside Scanner.Start().
+func (w *Watcher) Start() {
+	for {
+		select {
+		case event, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			w.handleEvent(event)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("watcher error: %v\n", err)
+		}
+	}
+}
+
+func (w *Watcher) handleEvent(event fsnotify.Event) {
+	// a freshly created directory needs its own watch so we see events
+	// that happen inside it (eg. tracks being written into a new album)
+	if event.Op&fsnotify.Create == fsnotify.Create {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			w.fsw.Add(event.Name)
+		}
+	}
+	w.debounce(filepath.Dir(event.Name))
+}
+
+// debounce coalesces bursts of events for the same directory into a single
+// rescan, fired after the directory's been quiet for debounceWindow.
+func (w *Watcher) debounce(dir string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if timer, ok := w.pending[dir]; ok {
+		timer.Reset(debounceWindow)
+		return
+	}
+	w.pending[dir] = time.AfterFunc(debounceWindow, func() {
+		w.mu.Lock()
+		delete(w.pending, dir)
+		w.mu.Unlock()
+		if err := w.scanner.RescanPath(dir); err != nil {
+			log.Printf("error rescanning `%s`: %v\n", dir, err)
+		}
+	})
+}
+
+// Close stops the underlying fsnotify watcher. Any rescans already queued
+// by debounce still fire.
+func (w *Watcher) Close() error {
+	return w.fsw.Close()
+}
+
+// libraryForPath returns the configured library that contains p, so a
+// rescan can be scoped and have its records tagged with the right
+// LibraryID. The prefix check requires a path separator (or an exact
+// match on the library root) so that sibling libraries with one path a
+// prefix of another - eg. `/music` and `/music2` - can't have each
+// other's events misattributed.
+func (s *Scanner) libraryForPath(p string) (*db.MusicFolder, error) {
+	for _, library := range s.libraries {
+		if p == library.Path || strings.HasPrefix(p, library.Path+string(os.PathSeparator)) {
+			return library, nil
+		}
+	}
+	return nil, fmt.Errorf("path `%s` is not inside any configured library", p)
+}
+
+// seedDirStack primes currentDirStack with path's real parent folder
+// before a rescan replays handleFolder on it, so PeekID() returns the
+// folder's actual ParentID instead of 0. Without this, handleFolder would
+// save path with its ParentID reset to zero and silently orphan it from
+// the rest of the folder tree on every incremental rescan.
+func (s *Scanner) seedDirStack(path string) error {
+	if existing, err := s.tx.GetFolderByPath(path, s.currentLibrary.ID); err == nil {
+		s.currentDirStack.Push(&db.Folder{ID: existing.ParentID})
+		return nil
+	} else if !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+	// path has no folder row of its own yet (eg. it was only just
+	// created) - find its parent's instead, so the new row gets the
+	// right ParentID when handleFolder saves it
+	parentPath := filepath.Dir(path)
+	if parentPath == path {
+		return nil
+	}
+	parent, err := s.tx.GetFolderByPath(parentPath, s.currentLibrary.ID)
+	if gorm.IsRecordNotFoundError(err) {
+		return nil // parentPath has no folder row either (eg. path is the library root), nothing to seed
+	}
+	if err != nil {
+		return err
+	}
+	s.currentDirStack.Push(parent)
+	return nil
+}
+
+// RescanPath performs a lightweight rescan of a single directory, reusing
+// handleFolder/handleTrack/handleFolderCompletion, instead of walking the
+// whole tree. It's what the watcher calls after its debounce window, and
+// what ServeStartScan uses when given a `musicFolderId`, to rescan recent
+// changes in that one library.
+func (s *Scanner) RescanPath(path string) error {
+	if atomic.LoadInt32(&IsScanning) == 1 {
+		return errors.New("already scanning")
+	}
+	library, err := s.libraryForPath(path)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&IsScanning, 1)
+	defer atomic.StoreInt32(&IsScanning, 0)
+	defer logElapsed(time.Now(), "rescanning "+path)
+	s.currentLibrary = library
+	s.resetLibraryState()
+	return s.ds.WithTx(func(tx db.DataStore) error {
+		s.tx = tx
+		if err := s.seedDirStack(path); err != nil {
+			return errors.Wrap(err, "seeding folder ancestry")
+		}
+		err := godirwalk.Walk(path, &godirwalk.Options{
+			Callback:             s.handleItem,
+			PostChildrenCallback: s.handleFolderCompletion,
+			Unsorted:             true,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "walking path `%s`", path)
+		}
+		return nil
+	})
+}
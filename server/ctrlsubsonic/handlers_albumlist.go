@@ -0,0 +1,36 @@
+package ctrlsubsonic
+
+import (
+	"net/http"
+
+	"senan.xyz/g/gonic/server/ctrlsubsonic/filter"
+	"senan.xyz/g/gonic/server/ctrlsubsonic/params"
+	"senan.xyz/g/gonic/server/ctrlsubsonic/spec"
+)
+
+func (c *Controller) ServeGetAlbumListTwo(r *http.Request) *spec.Response {
+	ds := c.DS.WithContext(r.Context())
+	params := r.Context().Value(CtxParams).(params.Params)
+	listType := params.GetOr("type", "newest")
+	strategy, ok := filter.Lookup(listType)
+	if !ok {
+		return spec.NewError(10, "unknown list type `%s`", listType)
+	}
+	opts := strategy(filter.Params{
+		FromYear: params.GetIntOr("fromYear", 0),
+		ToYear:   params.GetIntOr("toYear", 0),
+		Genre:    params.Get("genre"),
+	})
+	opts.MusicFolder = params.GetIntOr("musicFolderId", 0)
+	albums, err := ds.GetAlbumList(opts, params.GetIntOr("size", 10), params.GetIntOr("offset", 0))
+	if err != nil {
+		return spec.NewError(0, "error fetching album list: %v", err)
+	}
+	sub := spec.NewResponse()
+	sub.AlbumsTwo = &spec.AlbumList{}
+	sub.AlbumsTwo.List = make([]*spec.Album, len(albums))
+	for i, album := range albums {
+		sub.AlbumsTwo.List[i] = spec.NewAlbumByTags(album)
+	}
+	return sub
+}
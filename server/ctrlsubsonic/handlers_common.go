@@ -1,6 +1,7 @@
 package ctrlsubsonic
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,6 +13,7 @@ import (
 	"github.com/jinzhu/gorm"
 
 	"senan.xyz/g/gonic/db"
+	"senan.xyz/g/gonic/playlist/smart"
 	"senan.xyz/g/gonic/scanner"
 	"senan.xyz/g/gonic/server/ctrlsubsonic/params"
 	"senan.xyz/g/gonic/server/ctrlsubsonic/spec"
@@ -39,6 +41,7 @@ func (c *Controller) ServePing(r *http.Request) *spec.Response {
 }
 
 func (c *Controller) ServeScrobble(r *http.Request) *spec.Response {
+	ds := c.DS.WithContext(r.Context())
 	params := r.Context().Value(CtxParams).(params.Params)
 	id, err := params.GetInt("id")
 	if err != nil {
@@ -50,11 +53,10 @@ func (c *Controller) ServeScrobble(r *http.Request) *spec.Response {
 		return spec.NewError(0, "you don't have a last.fm session")
 	}
 	// fetch track for getting info to send to last.fm function
-	track := &db.Track{}
-	c.DB.
-		Preload("Album").
-		Preload("Artist").
-		First(track, id)
+	track, err := ds.GetTrack(id)
+	if err != nil {
+		return spec.NewError(70, "couldn't find a track with id `%d`", id)
+	}
 	// scrobble with above info
 	opts := lastfm.ScrobbleOpts{
 		Track: track,
@@ -64,8 +66,8 @@ func (c *Controller) ServeScrobble(r *http.Request) *spec.Response {
 		Submission: params.GetOr("submission", "true") != "false",
 	}
 	err = lastfm.Scrobble(
-		c.DB.GetSetting("lastfm_api_key"),
-		c.DB.GetSetting("lastfm_secret"),
+		ds.GetProperty("lastfm_api_key"),
+		ds.GetProperty("lastfm_secret"),
 		user.LastFMSession,
 		opts,
 	)
@@ -76,9 +78,18 @@ func (c *Controller) ServeScrobble(r *http.Request) *spec.Response {
 }
 
 func (c *Controller) ServeGetMusicFolders(r *http.Request) *spec.Response {
+	ds := c.DS.WithContext(r.Context())
+	libraries, err := ds.GetMusicFolders()
+	if err != nil {
+		return spec.NewError(0, "error fetching music folders: %v", err)
+	}
 	folders := &spec.MusicFolders{}
-	folders.List = []*spec.MusicFolder{
-		{ID: 1, Name: "music"},
+	folders.List = make([]*spec.MusicFolder, len(libraries))
+	for i, library := range libraries {
+		folders.List[i] = &spec.MusicFolder{
+			ID:   library.ID,
+			Name: library.Name,
+		}
 	}
 	sub := spec.NewResponse()
 	sub.MusicFolders = folders
@@ -86,6 +97,20 @@ func (c *Controller) ServeGetMusicFolders(r *http.Request) *spec.Response {
 }
 
 func (c *Controller) ServeStartScan(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	// a `musicFolderId` here means "just rescan recent changes in this
+	// folder", which is much cheaper than a full walk of every library
+	if folderID, err := params.GetInt("musicFolderId"); err == nil {
+		ds := c.DS.WithContext(r.Context())
+		if folder, err := ds.GetMusicFolder(folderID); err == nil {
+			go func() {
+				if err := c.Scanner.RescanPath(folder.Path); err != nil {
+					log.Printf("error while rescanning `%s`: %v\n", folder.Path, err)
+				}
+			}()
+			return c.ServeGetScanStatus(r)
+		}
+	}
 	go func() {
 		if err := c.Scanner.Start(); err != nil {
 			log.Printf("error while scanning: %v\n", err)
@@ -95,10 +120,8 @@ func (c *Controller) ServeStartScan(r *http.Request) *spec.Response {
 }
 
 func (c *Controller) ServeGetScanStatus(r *http.Request) *spec.Response {
-	var trackCount int
-	c.DB.
-		Model(db.Track{}).
-		Count(&trackCount)
+	ds := c.DS.WithContext(r.Context())
+	trackCount, _ := ds.CountTracks()
 	sub := spec.NewResponse()
 	sub.ScanStatus = &spec.ScanStatus{
 		Scanning: scanner.IsScanning(),
@@ -124,14 +147,16 @@ func (c *Controller) ServeNotFound(r *http.Request) *spec.Response {
 }
 
 func (c *Controller) ServeGetPlaylists(r *http.Request) *spec.Response {
+	ds := c.DS.WithContext(r.Context())
 	user := r.Context().Value(CtxUser).(*db.User)
-	var playlists []*db.Playlist
-	c.DB.Where("user_id=?", user.ID).Find(&playlists)
+	playlists, err := ds.GetPlaylistsByUser(user.ID)
+	if err != nil {
+		return spec.NewError(0, "error fetching playlists: %v", err)
+	}
 	sub := spec.NewResponse()
 	sub.Playlists = &spec.Playlists{
 		List: make([]*spec.Playlist, len(playlists)),
 	}
-	fmt.Println("aaaa")
 	for i, playlist := range playlists {
 		sub.Playlists.List[i] = spec.NewPlaylist(playlist)
 		sub.Playlists.List[i].Owner = user.Name
@@ -141,38 +166,55 @@ func (c *Controller) ServeGetPlaylists(r *http.Request) *spec.Response {
 }
 
 func (c *Controller) ServeGetPlaylist(r *http.Request) *spec.Response {
+	ds := c.DS.WithContext(r.Context())
 	params := r.Context().Value(CtxParams).(params.Params)
 	playlistID, err := params.GetInt("id")
 	if err != nil {
 		return spec.NewError(10, "please provide an `id` parameter")
 	}
-	playlist := db.Playlist{}
-	err = c.DB.
-		Where("id=?", playlistID).
-		Find(&playlist).
-		Error
+	playlist, err := ds.GetPlaylist(playlistID)
 	if gorm.IsRecordNotFoundError(err) {
 		return spec.NewError(70, "playlist with id `%d` not found", playlistID)
 	}
+	var tracks []*db.Track
+	if playlist.IsSmart() {
+		tracks, err = smartPlaylistTracks(ds, playlist)
+		if err != nil {
+			return spec.NewError(0, "error materialising smart playlist: %v", err)
+		}
+	} else {
+		_, tracks, err = ds.GetPlaylistWithTracks(playlistID)
+		if err != nil {
+			return spec.NewError(0, "error fetching playlist tracks: %v", err)
+		}
+	}
 	user := r.Context().Value(CtxUser).(*db.User)
 	sub := spec.NewResponse()
-	sub.Playlist = spec.NewPlaylist(&playlist)
+	sub.Playlist = spec.NewPlaylist(playlist)
 	sub.Playlist.Owner = user.Name
-	sub.Playlist.SongCount = playlist.TrackCount
-	trackIDs := playlist.GetItems()
-	sub.Playlist.List = make([]*spec.TrackChild, len(trackIDs))
-	for i, id := range trackIDs {
-		track := db.Track{}
-		c.DB.
-			Where("id=?", id).
-			Preload("Album").
-			Find(&track)
-		sub.Playlist.List[i] = spec.NewTCTrackByFolder(&track, track.Album)
+	sub.Playlist.SongCount = len(tracks)
+	sub.Playlist.List = make([]*spec.TrackChild, len(tracks))
+	for i, track := range tracks {
+		sub.Playlist.List[i] = spec.NewTCTrackByFolder(track, track.Album)
 	}
 	return sub
 }
 
+// smartPlaylistTracks compiles and runs a smart playlist's saved rules.
+func smartPlaylistTracks(ds db.DataStore, playlist *db.Playlist) ([]*db.Track, error) {
+	var rules smart.Rules
+	if err := json.Unmarshal([]byte(playlist.Rules), &rules); err != nil {
+		return nil, fmt.Errorf("parsing rules: %v", err)
+	}
+	query, err := smart.Compile(rules)
+	if err != nil {
+		return nil, fmt.Errorf("compiling rules: %v", err)
+	}
+	return ds.GetSmartPlaylistTracks(query)
+}
+
 func (c *Controller) ServeUpdatePlaylist(r *http.Request) *spec.Response {
+	ds := c.DS.WithContext(r.Context())
 	user := r.Context().Value(CtxUser).(*db.User)
 	params := r.Context().Value(CtxParams).(params.Params)
 	var playlistID int
@@ -181,10 +223,10 @@ func (c *Controller) ServeUpdatePlaylist(r *http.Request) *spec.Response {
 	}
 	// playlistID may be 0 from above. in that case we get a new playlist
 	// as intended
-	var playlist db.Playlist
-	c.DB.
-		Where("id=?", playlistID).
-		FirstOrCreate(&playlist)
+	playlist, err := ds.GetOrCreatePlaylist(playlistID)
+	if err != nil {
+		return spec.NewError(0, "error fetching playlist: %v", err)
+	}
 	// ** begin update meta info
 	playlist.UserID = user.ID
 	if val := params.Get("name"); val != "" {
@@ -193,39 +235,70 @@ func (c *Controller) ServeUpdatePlaylist(r *http.Request) *spec.Response {
 	if val := params.Get("comment"); val != "" {
 		playlist.Comment = val
 	}
-	trackIDs := playlist.GetItems()
-	// ** begin delete items
-	if p := params.GetFirstListInt("songIndexToRemove"); p != nil {
-		sort.Sort(sort.Reverse(sort.IntSlice(p)))
-		for _, i := range p {
-			trackIDs = append(trackIDs[:i], trackIDs[i+1:]...)
+	// a `rules` parameter makes (or edits) this a smart playlist - its
+	// membership is computed on the fly, so it has no playlist_tracks
+	// rows of its own
+	if rules := params.Get("rules"); rules != "" {
+		if _, err := smart.Compile(parseRules(rules)); err != nil {
+			return spec.NewError(0, "invalid smart playlist rules: %v", err)
 		}
+		playlist.Rules = rules
+		ds.SavePlaylist(playlist)
+		return spec.NewResponse()
 	}
-	// ** begin add items
-	if p := params.GetFirstListInt("songId", "songIdToAdd"); p != nil {
-		trackIDs = append(trackIDs, p...)
+	ds.SavePlaylist(playlist)
+	removeIdx := params.GetFirstListInt("songIndexToRemove")
+	addIDs := params.GetFirstListInt("songId", "songIdToAdd")
+	switch {
+	case removeIdx != nil:
+		// removing by index needs the whole ordered list rebuilt, since
+		// playlist_tracks rows aren't addressable by index alone
+		_, tracks, _ := ds.GetPlaylistWithTracks(playlist.ID)
+		trackIDs := make([]int, len(tracks))
+		for i, track := range tracks {
+			trackIDs[i] = track.ID
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(removeIdx)))
+		for _, i := range removeIdx {
+			trackIDs = append(trackIDs[:i], trackIDs[i+1:]...)
+		}
+		trackIDs = append(trackIDs, addIDs...)
+		ds.SetPlaylistTracks(playlist.ID, trackIDs)
+	case addIDs != nil:
+		// a pure add appends, so there's nothing to rebuild - insert
+		// each track at the end instead
+		_, tracks, _ := ds.GetPlaylistWithTracks(playlist.ID)
+		position := len(tracks)
+		for _, trackID := range addIDs {
+			if err := ds.InsertPlaylistTrack(playlist.ID, trackID, position); err != nil {
+				return spec.NewError(0, "error adding track: %v", err)
+			}
+			position++
+		}
 	}
-	//
-	playlist.SetItems(trackIDs)
-	c.DB.Save(playlist)
 	return spec.NewResponse()
 }
 
+// parseRules unmarshals a `rules` parameter into a smart.Rules tree,
+// returning the zero value (which smart.Compile rejects for having no
+// limit) on bad JSON rather than erroring twice.
+func parseRules(raw string) smart.Rules {
+	var rules smart.Rules
+	json.Unmarshal([]byte(raw), &rules)
+	return rules
+}
+
 func (c *Controller) ServeDeletePlaylist(r *http.Request) *spec.Response {
+	ds := c.DS.WithContext(r.Context())
 	params := r.Context().Value(CtxParams).(params.Params)
-	c.DB.
-		Where("id=?", params.GetIntOr("id", 0)).
-		Delete(&db.Playlist{})
+	ds.DeletePlaylist(params.GetIntOr("id", 0))
 	return spec.NewResponse()
 }
 
 func (c *Controller) ServeGetPlayQueue(r *http.Request) *spec.Response {
+	ds := c.DS.WithContext(r.Context())
 	user := r.Context().Value(CtxUser).(*db.User)
-	queue := db.PlayQueue{}
-	err := c.DB.
-		Where("user_id=?", user.ID).
-		Find(&queue).
-		Error
+	queue, err := ds.GetPlayQueue(user.ID)
 	if gorm.IsRecordNotFoundError(err) {
 		return spec.NewResponse()
 	}
@@ -236,48 +309,40 @@ func (c *Controller) ServeGetPlayQueue(r *http.Request) *spec.Response {
 	sub.PlayQueue.Current = queue.Current
 	sub.PlayQueue.Changed = queue.UpdatedAt
 	sub.PlayQueue.ChangedBy = queue.ChangedBy
-	trackIDs := queue.GetItems()
-	sub.PlayQueue.List = make([]*spec.TrackChild, len(trackIDs))
-	for i, id := range trackIDs {
-		track := db.Track{}
-		c.DB.
-			Where("id=?", id).
-			Preload("Album").
-			Find(&track)
-		sub.PlayQueue.List[i] = spec.NewTCTrackByFolder(&track, track.Album)
+	tracks, _ := ds.GetTracksByIDs(queue.GetItems())
+	sub.PlayQueue.List = make([]*spec.TrackChild, len(tracks))
+	for i, track := range tracks {
+		sub.PlayQueue.List[i] = spec.NewTCTrackByFolder(track, track.Album)
 	}
 	return sub
 }
 
 func (c *Controller) ServeSavePlayQueue(r *http.Request) *spec.Response {
+	ds := c.DS.WithContext(r.Context())
 	params := r.Context().Value(CtxParams).(params.Params)
 	tracks := params.GetFirstListInt("id")
 	if tracks == nil {
 		return spec.NewError(10, "please provide some `id` parameters")
 	}
 	user := r.Context().Value(CtxUser).(*db.User)
-	queue := &db.PlayQueue{UserID: user.ID}
-	c.DB.Where(queue).First(queue)
+	queue, _ := ds.GetPlayQueue(user.ID)
+	queue.UserID = user.ID
 	queue.Current = params.GetIntOr("current", 0)
 	queue.Position = params.GetIntOr("position", 0)
 	queue.ChangedBy = params.Get("c")
 	queue.SetItems(tracks)
-	c.DB.Save(queue)
+	ds.SavePlayQueue(queue)
 	return spec.NewResponse()
 }
 
 func (c *Controller) ServeGetSong(r *http.Request) *spec.Response {
+	ds := c.DS.WithContext(r.Context())
 	params := r.Context().Value(CtxParams).(params.Params)
 	id, err := params.GetInt("id")
 	if err != nil {
 		return spec.NewError(10, "provide an `id` parameter")
 	}
-	track := &db.Track{}
-	err = c.DB.
-		Where("id=?", id).
-		Preload("Album").
-		First(track).
-		Error
+	track, err := ds.GetTrack(id)
 	if gorm.IsRecordNotFoundError(err) {
 		return spec.NewError(10, "couldn't find a track with that id")
 	}
@@ -287,19 +352,19 @@ func (c *Controller) ServeGetSong(r *http.Request) *spec.Response {
 }
 
 func (c *Controller) ServeGetRandomSongs(r *http.Request) *spec.Response {
+	ds := c.DS.WithContext(r.Context())
 	params := r.Context().Value(CtxParams).(params.Params)
 	// TODO: add genre restraint here
-	var tracks []*db.Track
-	c.DB.DB.
-		Limit(params.GetIntOr("size", 10)).
-		Where(
-			"albums.tag_year BETWEEN ? AND ?",
-			params.GetIntOr("fromYear", 1800),
-			params.GetIntOr("toYear", 2200)).
-		Joins("JOIN albums ON tracks.album_id=albums.id").
-		Preload("Album").
-		Order(gorm.Expr("random()")).
-		Find(&tracks)
+	folderID, _ := params.GetInt("musicFolderId")
+	tracks, err := ds.GetRandomTracks(db.RandomTracksOptions{
+		Size:        params.GetIntOr("size", 10),
+		FromYear:    params.GetIntOr("fromYear", 1800),
+		ToYear:      params.GetIntOr("toYear", 2200),
+		MusicFolder: folderID,
+	})
+	if err != nil {
+		return spec.NewError(0, "error fetching random songs: %v", err)
+	}
 	sub := spec.NewResponse()
 	sub.RandomTracks = &spec.RandomTracks{}
 	sub.RandomTracks.List = make([]*spec.TrackChild, len(tracks))
@@ -0,0 +1,124 @@
+// Package tags reads the audio tags gonic cares about from a track, across
+// ID3v2, Vorbis comments, and MP4 atoms. It used to live inline in the
+// scanner as a private readTags helper; splitting it out means the
+// scanner doesn't need to know about any particular tag format, and the
+// `gonic inspect` command can reuse it to print a file's parsed tags.
+package tags
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dhowden/tag"
+)
+
+// these are the raw key names dhowden/tag surfaces in Raw() for the
+// identifiers we care about that it doesn't expose through its own
+// Metadata interface. ID3v2 uses TXXX frames, Vorbis/FLAC uses comment
+// field names, and MP4 uses freeform atoms - dhowden/tag normalises all
+// three into this one string-keyed map.
+const (
+	keyMusicBrainzTrackID       = "MUSICBRAINZ_TRACKID"
+	keyMusicBrainzAlbumID       = "MUSICBRAINZ_ALBUMID"
+	keyMusicBrainzArtistID      = "MUSICBRAINZ_ARTISTID"
+	keyMusicBrainzAlbumArtistID = "MUSICBRAINZ_ALBUMARTISTID"
+	keyReplayGainTrackGain      = "REPLAYGAIN_TRACK_GAIN"
+	keyReplayGainTrackPeak      = "REPLAYGAIN_TRACK_PEAK"
+	keyReplayGainAlbumGain      = "REPLAYGAIN_ALBUM_GAIN"
+	keyReplayGainAlbumPeak      = "REPLAYGAIN_ALBUM_PEAK"
+	keyDiscSubtitle             = "DISCSUBTITLE"
+	// ID3v2 TPE1/Vorbis ARTIST can be repeated or separated in whichever
+	// way the tagger felt like that day
+	keyArtistsSeparators = ";/"
+)
+
+// Tags is a parsed set of tags for one file. It wraps tag.Metadata for
+// the fields that library already normalises well, and reads everything
+// else out of its raw atom/frame/comment map.
+type Tags struct {
+	meta tag.Metadata
+	raw  map[string]string
+}
+
+// Read parses the tags at path.
+func Read(path string) (*Tags, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	meta, err := tag.ReadFrom(f)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]string{}
+	for key, val := range meta.Raw() {
+		if str, ok := val.(string); ok {
+			raw[strings.ToUpper(key)] = str
+		}
+	}
+	return &Tags{meta: meta, raw: raw}, nil
+}
+
+func (t *Tags) Title() string  { return t.meta.Title() }
+func (t *Tags) Album() string  { return t.meta.Album() }
+func (t *Tags) Artist() string { return t.meta.Artist() }
+func (t *Tags) Year() int      { return t.meta.Year() }
+
+func (t *Tags) AlbumArtist() string {
+	if artist := t.meta.AlbumArtist(); artist != "" {
+		return artist
+	}
+	return t.meta.Artist()
+}
+
+func (t *Tags) Track() (int, int) { return t.meta.Track() }
+func (t *Tags) Disc() (int, int)  { return t.meta.Disc() }
+
+// DiscSubtitle is the DISCSUBTITLE/TSST frame, eg. "Disc 2: B-Sides".
+func (t *Tags) DiscSubtitle() string {
+	return t.raw[keyDiscSubtitle]
+}
+
+// Artists splits a multi-value artist tag (eg. "Foo; Bar/Baz") into its
+// individual names, falling back to the single Artist() value.
+func (t *Tags) Artists() []string {
+	raw := t.Artist()
+	if raw == "" {
+		return nil
+	}
+	parts := strings.FieldsFunc(raw, func(r rune) bool {
+		return strings.ContainsRune(keyArtistsSeparators, r)
+	})
+	artists := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if trimmed := strings.TrimSpace(part); trimmed != "" {
+			artists = append(artists, trimmed)
+		}
+	}
+	return artists
+}
+
+func (t *Tags) MusicBrainzTrackID() string       { return t.raw[keyMusicBrainzTrackID] }
+func (t *Tags) MusicBrainzAlbumID() string       { return t.raw[keyMusicBrainzAlbumID] }
+func (t *Tags) MusicBrainzArtistID() string      { return t.raw[keyMusicBrainzArtistID] }
+func (t *Tags) MusicBrainzAlbumArtistID() string { return t.raw[keyMusicBrainzAlbumArtistID] }
+
+func (t *Tags) ReplayGainTrackGain() float64 { return t.parseGain(keyReplayGainTrackGain) }
+func (t *Tags) ReplayGainTrackPeak() float64 { return t.parseGain(keyReplayGainTrackPeak) }
+func (t *Tags) ReplayGainAlbumGain() float64 { return t.parseGain(keyReplayGainAlbumGain) }
+func (t *Tags) ReplayGainAlbumPeak() float64 { return t.parseGain(keyReplayGainAlbumPeak) }
+
+func (t *Tags) parseGain(key string) float64 {
+	raw := strings.TrimSuffix(strings.TrimSpace(t.raw[key]), " dB")
+	val, _ := strconv.ParseFloat(raw, 64)
+	return val
+}
+
+// Raw returns every string-valued tag this file carried, keyed by its
+// upper-cased name, for `gonic inspect`. Tags with non-text values are
+// left out.
+func (t *Tags) Raw() map[string]string {
+	return t.raw
+}